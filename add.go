@@ -0,0 +1,183 @@
+// Copyright Christoffer G. Thomsen 2016
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE or copy at
+// http://www.boost.org/LICENSE_1_0.txt)
+
+package main // import "cgt.name/pkg/addkey"
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"cgt.name/pkg/addkey/authkeys"
+)
+
+// addKeyToTarget pulls t's authorized_keys, appends key if it isn't already
+// present, and pushes the result back. It holds t's lock for the duration,
+// so targets of this addkey process that share a remote/container
+// serialize; separate addkey processes are not serialized.
+func addKeyToTarget(cc *clientCache, t Target, key authkeys.Key, allowed []string) error {
+	lock := targetLocks.lockFor(t.lockKey())
+	lock.Lock()
+	defer lock.Unlock()
+
+	c, err := cc.get(t.Remote)
+	if err != nil {
+		return fmt.Errorf("error connecting to LXD: %v", err)
+	}
+
+	original, err := t.PullRaw(c)
+	if err != nil {
+		return err
+	}
+
+	keys, err := authkeys.ReadAll(bytes.NewReader(original), allowed)
+	if err != nil {
+		return err
+	}
+
+	keys, err = authkeys.Add(keys, key)
+	if err != nil {
+		return err
+	}
+
+	if err := t.Push(c, keys, original); err != nil {
+		return fmt.Errorf("error pushing new authorized_keys: %v", err)
+	}
+
+	return nil
+}
+
+// runAdd implements `addkey add`, which is also addkey's default subcommand.
+func runAdd(args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	keyFlag := fs.String("i", "", "specify public key file to use")
+	userFlag := fs.String("u", defaultUser, "user whose authorized_keys to edit, unless overridden per-target")
+	remoteFlag := fs.String("remote", "", "LXD remote to use, as configured for the lxc/lxd CLI (default: local daemon socket)")
+	allFlag := fs.Bool("all", false, "operate on every running container reported by LXD, instead of the targets given on the command line")
+	optionsFlag := fs.String("options", "", "comma-separated options (e.g. no-port-forwarding,no-agent-forwarding) to prepend to the added key")
+	algosFlag := fs.String("algos", "", "comma-separated allowlist of accepted key algorithms (default: all algorithms supported by x/crypto/ssh except ssh-dss)")
+	generateFlag := fs.Bool("generate", false, "if -i is not given and $HOME/.ssh/id_rsa.pub doesn't exist, generate a fresh keypair and use it")
+	typeFlag := fs.String("type", "ed25519", "key type to generate with -generate: ed25519, rsa, or ecdsa")
+	bitsFlag := fs.Int("bits", 0, "key size to generate with -generate (rsa default 4096, ecdsa default 256)")
+	fs.Parse(args)
+
+	targetArgs := fs.Args()
+	if len(targetArgs) == 0 && !*allFlag {
+		fs.Usage()
+		return errors.New("no targets given")
+	}
+
+	var keyPath string
+	if len(*keyFlag) != 0 {
+		keyPath = *keyFlag
+	} else {
+		keyPath = os.ExpandEnv("$HOME/.ssh/id_rsa.pub")
+	}
+
+	allowed := authkeys.DefaultAllowedAlgos
+	if len(*algosFlag) != 0 {
+		allowed = strings.Split(*algosFlag, ",")
+	}
+
+	targets, err := resolveTargets(targetArgs, *userFlag, *remoteFlag, *allFlag)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return errors.New("no targets given")
+	}
+
+	var (
+		key         authkeys.Key
+		generatedTo string
+	)
+	if *generateFlag && len(*keyFlag) == 0 && !fileExists(keyPath) {
+		key, generatedTo, err = generateAndWriteKey(*typeFlag, *bitsFlag, targets[0].Container)
+		if err != nil {
+			return fmt.Errorf("error generating key: %v", err)
+		}
+	} else {
+		keybuf, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return fmt.Errorf("error reading key: %v", err)
+		}
+		key, err = authkeys.Parse(keybuf, allowed)
+		if err != nil {
+			return err
+		}
+		if key.Key == nil {
+			return fmt.Errorf("%s does not contain a key", keyPath)
+		}
+	}
+	if len(*optionsFlag) != 0 {
+		key.Options = append(strings.Split(*optionsFlag, ","), key.Options...)
+	}
+
+	cc := newClientCache(*remoteFlag)
+	results := processTargets(targets, func(t Target) error {
+		return addKeyToTarget(cc, t, key, allowed)
+	})
+
+	if err := summarizeResults(results); err != nil {
+		return err
+	}
+
+	if len(generatedTo) != 0 {
+		fmt.Printf("generated private key: %s\n", generatedTo)
+		for _, t := range targets {
+			printSSHHint(cc, t, generatedTo)
+		}
+	}
+
+	return nil
+}
+
+// fileExists reports whether os.Stat succeeds on path. It does not check
+// that path is readable.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// generateAndWriteKey generates a new keypair of keyType/bits, writes it to
+// $HOME/.ssh/id_<container>_<keyType>{,.pub}, and returns the key to push
+// along with the private key's path.
+func generateAndWriteKey(keyType string, bits int, container string) (authkeys.Key, string, error) {
+	priv, pub, err := generateKeyPair(keyType, bits)
+	if err != nil {
+		return authkeys.Key{}, "", err
+	}
+
+	comment := fmt.Sprintf("addkey@%s", container)
+	privPath := os.ExpandEnv(fmt.Sprintf("$HOME/.ssh/id_%s_%s", container, keyType))
+
+	if err := writeGeneratedKeyPair(priv, pub, comment, privPath); err != nil {
+		return authkeys.Key{}, "", err
+	}
+
+	return authkeys.Key{Key: pub, Comment: comment}, privPath, nil
+}
+
+// printSSHHint prints a ready-to-copy ssh invocation for t, using its
+// container's discovered IP address.
+func printSSHHint(cc *clientCache, t Target, privPath string) {
+	c, err := cc.get(t.Remote)
+	if err != nil {
+		perr(fmt.Errorf("%s: %v", t, err))
+		return
+	}
+
+	ip, err := c.ContainerIP(t.Container)
+	if err != nil {
+		perr(fmt.Errorf("%s: %v", t, err))
+		return
+	}
+
+	fmt.Printf("ssh -i %s %s@%s\n", privPath, t.User, ip)
+}
@@ -3,24 +3,33 @@
 // (See accompanying file LICENSE or copy at
 // http://www.boost.org/LICENSE_1_0.txt)
 
-// Command addkey adds a public key to an LXD container's root authorized_keys.
+// Command addkey manages public keys in one or more LXD containers'
+// authorized_keys files.
 //
-// By default, addkey will use $HOME/.ssh/id_rsa.pub.
-// Using the `-i PUBKEYFILE` flag will make it copy the specified key instead.
+// It has four subcommands: add (the default, for backward compatibility),
+// list, remove, and rotate. Each takes one or more targets of the form
+// `[remote:]container[/user]`, e.g. `myremote:web/deploy`; the user
+// defaults to root, or to whatever -u specifies. The -all flag operates on
+// every running container instead of explicit targets.
+//
+// By default, `addkey add` uses $HOME/.ssh/id_rsa.pub; -i PUBKEYFILE copies
+// the specified key instead. With -generate, if -i is not given and
+// $HOME/.ssh/id_rsa.pub doesn't exist, `addkey add` generates a fresh keypair (see -type and -bits) and uses it,
+// turning addkey into a one-shot bootstrap tool for fresh containers.
+//
+// The underlying authorized_keys manipulation is implemented in
+// cgt.name/pkg/addkey/authkeys, which other Go programs can import
+// directly.
 package main // import "cgt.name/pkg/addkey"
 
 import (
-	"bufio"
 	"bytes"
-	"errors"
-	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"sync"
 
-	"golang.org/x/crypto/ssh"
+	"cgt.name/pkg/addkey/authkeys"
 )
 
 // perr prints an error to stderr
@@ -28,213 +37,131 @@ func perr(e error) {
 	fmt.Fprintf(os.Stderr, "Error: %v\n", e)
 }
 
-// rmTmpFile closes and deletes a file.
-func rmFile(f *os.File) {
-	err := f.Close()
-	if err != nil {
-		perr(fmt.Errorf("error closing temp file: %v\n", err))
-	}
-	err = os.Remove(f.Name())
-	if err != nil {
-		perr(fmt.Errorf("error deleting temp file: %v\n", err))
+// newClient returns the Client to use to talk to LXD: a local Unix socket
+// client by default, or an HTTPS client for the configured remote when
+// remote is non-empty.
+func newClient(remote string) (Client, error) {
+	if len(remote) == 0 {
+		return newLocalClient()
 	}
-}
 
-// lxcPull uses the `lxc file pull` command to retrieve a file from a container.
-func lxcPull(dstPath, srcPath string) error {
-	pull := exec.Command("lxc", "file", "pull", srcPath, dstPath)
-	err := pull.Run()
+	rc, err := lookupRemote(remote)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
-}
-
-// lxcPush uses the `lxc file push` command to copy a file to a container.
-// The file will be owned by root:root with permissions 640 inside the container.
-func lxcPush(dstPath, srcPath string) error {
-	push := exec.Command("lxc", "file", "push", "--uid=0", "--gid=0", "--mode=640", srcPath, dstPath)
-	err := push.Run()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-type authKey struct {
-	Key     ssh.PublicKey
-	Comment string
-}
-
-func (k authKey) MarshalWithComment() []byte {
-	var buf bytes.Buffer
-	buf.Write(bytes.TrimSpace(ssh.MarshalAuthorizedKey(k.Key)))
-	buf.WriteByte(' ')
-	buf.WriteString(k.Comment)
-	buf.WriteByte('\n')
-	return buf.Bytes()
+	return newRemoteClient(rc)
 }
 
-var errUnsupportedKeyAlgo = fmt.Errorf("unsupported key algorithm. Supported algorithms: %s, %s, %s, %s, %s.",
-	ssh.KeyAlgoRSA,
-	ssh.KeyAlgoDSA,
-	ssh.KeyAlgoECDSA256,
-	ssh.KeyAlgoECDSA384,
-	ssh.KeyAlgoECDSA521,
-)
-
-func parseAuthKey(line []byte) (authKey, error) {
-	supported := false
-
-	if bytes.HasPrefix(line, []byte(ssh.KeyAlgoRSA)) {
-		supported = true
-	} else if bytes.HasPrefix(line, []byte(ssh.KeyAlgoDSA)) {
-		supported = true
-	} else if bytes.HasPrefix(line, []byte(ssh.KeyAlgoECDSA256)) {
-		supported = true
-	} else if bytes.HasPrefix(line, []byte(ssh.KeyAlgoECDSA384)) {
-		supported = true
-	} else if bytes.HasPrefix(line, []byte(ssh.KeyAlgoECDSA521)) {
-		supported = true
-	}
-
-	if !supported {
-		return authKey{}, errUnsupportedKeyAlgo
-	}
+// clientCache resolves and caches one Client per LXD remote name, so
+// targets that share a remote don't reconnect for every container. It is
+// safe for concurrent use, since processTargets calls get from multiple
+// goroutines at once.
+type clientCache struct {
+	defaultRemote string
 
-	key, comment, _, _, err := ssh.ParseAuthorizedKey(line)
-	if err != nil {
-		return authKey{}, fmt.Errorf("error parsing key: %v", err)
-	}
-	return authKey{key, comment}, nil
+	mu      sync.Mutex
+	clients map[string]Client
 }
 
-// readAuthorizedKeys reads public keys in the ssh authorized_keys format from
-// and io.Reader into `authKey`s and returns a slice of authKey.
-func readAuthorizedKeys(r io.Reader) ([]authKey, error) {
-	var keys []authKey
-
-	rr := bufio.NewReader(r)
-	for {
-		line, err := rr.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-
-		key, err := parseAuthKey(line)
-		if err != nil {
-			return nil, err
-		}
-		keys = append(keys, key)
-	}
-
-	return keys, nil
+func newClientCache(defaultRemote string) *clientCache {
+	return &clientCache{defaultRemote: defaultRemote, clients: make(map[string]Client)}
 }
 
-func writeAuthorizedKeys(f *os.File, keys []authKey, dstPath string) error {
-	if len(keys) == 0 {
-		return errors.New("no keys to write")
+func (cc *clientCache) get(remote string) (Client, error) {
+	if len(remote) == 0 {
+		remote = cc.defaultRemote
 	}
 
-	err := f.Truncate(0)
-	if err != nil {
-		return err
-	}
-	f.Seek(0, 0)
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
 
-	w := bufio.NewWriter(f)
-	for _, k := range keys {
-		_, err = w.Write(k.MarshalWithComment())
-		if err != nil {
-			return err
-		}
+	if c, ok := cc.clients[remote]; ok {
+		return c, nil
 	}
-
-	err = w.Flush()
+	c, err := newClient(remote)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	err = lxcPush(dstPath, f.Name())
-	if err != nil {
-		return err
-	}
-
-	return nil
+	cc.clients[remote] = c
+	return c, nil
 }
 
-func realmain(container string, keyFlag *string) error {
-	// Get key to add to authorized_keys.
-	var keyPath string
-	if len(*keyFlag) != 0 {
-		keyPath = *keyFlag
-	} else {
-		keyPath = os.ExpandEnv("$HOME/.ssh/id_rsa.pub")
-	}
-
-	keybuf, err := ioutil.ReadFile(keyPath)
-	if err != nil {
-		return fmt.Errorf("error reading key: %v", err)
-	}
-
-	key, err := parseAuthKey(keybuf)
-	if err != nil {
+// writeAuthorizedKeys durably rewrites container's dstPath authorized_keys
+// file, owned by user. It ensures dstPath's directory exists and belongs to
+// user (so this also works the first time on a freshly-launched container),
+// pushes the full contents to a sibling temp path inside the container,
+// then moves it into place with a single atomic exec so readers never
+// observe a partially written file, and finally syncs the container's
+// filesystems so the rename survives a crash. If the push or the rename
+// fails, it cleans up the remote temp file; a failed push leaves dstPath
+// untouched, and a failed rename restores dstPath to original when original
+// is non-nil.
+func writeAuthorizedKeys(c Client, container, dstPath, user string, keys []authkeys.Key, original []byte) error {
+	var buf bytes.Buffer
+	if err := authkeys.WriteAll(&buf, keys); err != nil {
 		return err
 	}
 
-	tmp, err := ioutil.TempFile("", "addkey")
-	if err != nil {
+	dir := filepath.Dir(dstPath)
+	if err := c.Exec(container, []string{"mkdir", "-p", "-m", "0700", dir}); err != nil {
 		return err
 	}
-	defer rmFile(tmp)
-
-	// Read root authorized_keys from container.
-	authKeysPath := fmt.Sprintf("%s/root/.ssh/authorized_keys", container)
-	err = lxcPull(tmp.Name(), authKeysPath)
-	if err != nil {
+	if err := c.Exec(container, []string{"chown", user, dir}); err != nil {
 		return err
 	}
 
-	keys, err := readAuthorizedKeys(tmp)
-	if err != nil {
+	remoteTmp := fmt.Sprintf("%s.tmp-%d", dstPath, os.Getpid())
+	if err := c.PushFile(container, remoteTmp, buf.Bytes(), 0, 0, 0640); err != nil {
+		c.Exec(container, []string{"rm", "-f", remoteTmp})
 		return err
 	}
 
-	// Check that key to add isn't already in authorized_keys.
-	keymarshal := key.Key.Marshal()
-	for _, k := range keys {
-		if bytes.Compare(keymarshal, k.Key.Marshal()) == 0 {
-			return fmt.Errorf("key already in authorized_keys")
+	if err := c.Exec(container, []string{"mv", "-f", remoteTmp, dstPath}); err != nil {
+		c.Exec(container, []string{"rm", "-f", remoteTmp})
+		if original != nil {
+			if restoreErr := c.PushFile(container, dstPath, original, 0, 0, 0640); restoreErr != nil {
+				return fmt.Errorf("%v (rollback also failed: %v)", err, restoreErr)
+			}
+			c.Exec(container, []string{"chown", user, dstPath})
 		}
+		return err
 	}
 
-	// Write authorized_keys with new key
-	keys = append(keys, key)
-	err = writeAuthorizedKeys(tmp, keys, authKeysPath)
-	if err != nil {
-		return fmt.Errorf("error pushing new authorized_keys: %v", err)
+	if err := c.Exec(container, []string{"chown", user, dstPath}); err != nil {
+		return err
 	}
 
-	return nil
+	return c.Exec(container, []string{"sync"})
 }
 
-// main parses flags/args and passes them to realmain.
-// If realmain returns a non-nil error, main prints the error to stderr and
-// exits with code 1.
+// main dispatches to the add/list/remove/rotate subcommands. With no
+// recognized subcommand, it defaults to add for backward compatibility with
+// earlier addkey versions.
 func main() {
-	keyFlag := flag.String("i", "", "specify public key file to use")
-	flag.Parse()
-
-	container := flag.Arg(0)
-	if len(container) == 0 {
+	if len(os.Args) < 2 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	err := realmain(container, keyFlag)
+	var (
+		sub  = os.Args[1]
+		args = os.Args[2:]
+		err  error
+	)
+
+	switch sub {
+	case "add":
+		err = runAdd(args)
+	case "list":
+		err = runList(args)
+	case "remove":
+		err = runRemove(args)
+	case "rotate":
+		err = runRotate(args)
+	default:
+		err = runAdd(os.Args[1:])
+	}
+
 	if err != nil {
 		perr(err)
 		os.Exit(1)
@@ -242,6 +169,5 @@ func main() {
 }
 
 func printUsage() {
-	fmt.Fprintf(os.Stderr, "usage: %s [OPTIONS] <container>\n", os.Args[0])
-	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "usage: %s add|list|remove|rotate [OPTIONS] [remote:]container[/user] [[remote:]container[/user] ...]\n", os.Args[0])
 }
@@ -0,0 +1,210 @@
+// Copyright Christoffer G. Thomsen 2016
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE or copy at
+// http://www.boost.org/LICENSE_1_0.txt)
+
+// Package authkeys implements reading, writing, and editing of
+// authorized_keys files, independent of where those files live. It is used
+// by the addkey command, and can be vendored by other Go programs that need
+// the same authorized_keys manipulation without the LXD-specific CLI.
+package authkeys // import "cgt.name/pkg/addkey/authkeys"
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultAllowedAlgos is the set of key algorithms Parse accepts when no
+// other allowlist is given: everything x/crypto/ssh can parse, except
+// ssh-dss, which is deprecated.
+var DefaultAllowedAlgos = []string{
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoSKED25519,
+	ssh.CertAlgoRSAv01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoSKECDSA256v01,
+	ssh.CertAlgoSKED25519v01,
+}
+
+// Key is one entry of an authorized_keys file. Key.Key is nil for entries
+// that aren't a parsed key - blank lines and comments - which are instead
+// round-tripped verbatim via raw.
+type Key struct {
+	Options []string
+	Key     ssh.PublicKey
+	Comment string
+
+	raw string
+}
+
+// Fingerprint returns the SHA256 fingerprint of k, as ssh-keygen -l prints
+// it. It panics if k is a passthrough entry; callers should check
+// k.Key != nil first.
+func (k Key) Fingerprint() string {
+	return ssh.FingerprintSHA256(k.Key)
+}
+
+// Equal reports whether k and other are the same key, ignoring options and
+// comment.
+func (k Key) Equal(other Key) bool {
+	if k.Key == nil || other.Key == nil {
+		return false
+	}
+	return bytes.Equal(k.Key.Marshal(), other.Key.Marshal())
+}
+
+// Marshal renders k as one line of an authorized_keys file, including its
+// trailing newline.
+func (k Key) Marshal() []byte {
+	if k.Key == nil {
+		return []byte(k.raw)
+	}
+
+	var buf bytes.Buffer
+	if len(k.Options) != 0 {
+		buf.WriteString(strings.Join(k.Options, ","))
+		buf.WriteByte(' ')
+	}
+	buf.Write(bytes.TrimSpace(ssh.MarshalAuthorizedKey(k.Key)))
+	buf.WriteByte(' ')
+	buf.WriteString(k.Comment)
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func algoAllowed(algo string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse parses one line of an authorized_keys file. Blank lines and comment
+// lines are preserved as passthrough entries rather than rejected. allowed
+// restricts which key algorithms are accepted; pass DefaultAllowedAlgos to
+// accept everything except ssh-dss.
+func Parse(line []byte, allowed []string) (Key, error) {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 || trimmed[0] == '#' {
+		return Key{raw: string(line)}, nil
+	}
+
+	key, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return Key{}, fmt.Errorf("error parsing key: %v", err)
+	}
+
+	if !algoAllowed(key.Type(), allowed) {
+		return Key{}, fmt.Errorf("unsupported key algorithm %q. Supported algorithms: %s", key.Type(), strings.Join(allowed, ", "))
+	}
+
+	return Key{Options: options, Key: key, Comment: comment}, nil
+}
+
+// ReadAll reads an authorized_keys file into a slice of Key, preserving
+// comments and blank lines as passthrough entries so that WriteAll can
+// round-trip them unchanged.
+func ReadAll(r io.Reader, allowed []string) ([]Key, error) {
+	var keys []Key
+
+	rr := bufio.NewReader(r)
+	for {
+		line, err := rr.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+
+		key, parseErr := Parse(line, allowed)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		keys = append(keys, key)
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return keys, nil
+}
+
+// WriteAll writes keys to w in authorized_keys format. An empty keys slice
+// writes nothing, so a file from which Remove has taken every entry ends up
+// empty.
+func WriteAll(w io.Writer, keys []Key) error {
+	for _, k := range keys {
+		if _, err := w.Write(k.Marshal()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add appends key to keys, returning an error if an equal key is already
+// present.
+func Add(keys []Key, key Key) ([]Key, error) {
+	for _, k := range keys {
+		if k.Equal(key) {
+			return nil, fmt.Errorf("key already in authorized_keys")
+		}
+	}
+	return append(append([]Key{}, keys...), key), nil
+}
+
+// Remove returns keys with every parsed key matching pred removed, along
+// with how many were removed. Passthrough entries are left untouched.
+func Remove(keys []Key, pred func(Key) bool) ([]Key, int) {
+	out := make([]Key, 0, len(keys))
+	removed := 0
+	for _, k := range keys {
+		if k.Key != nil && pred(k) {
+			removed++
+			continue
+		}
+		out = append(out, k)
+	}
+	return out, removed
+}
+
+// List returns the parsed keys in keys, excluding passthrough comment and
+// blank-line entries.
+func List(keys []Key) []Key {
+	var out []Key
+	for _, k := range keys {
+		if k.Key != nil {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// Rotate replaces the first key in keys equal to oldKey with newKey,
+// preserving position, and returns an error if oldKey isn't found.
+func Rotate(keys []Key, oldKey, newKey Key) ([]Key, error) {
+	out := append([]Key{}, keys...)
+	for i, k := range out {
+		if k.Equal(oldKey) {
+			out[i] = newKey
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("key not found in authorized_keys")
+}
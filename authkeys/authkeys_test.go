@@ -0,0 +1,155 @@
+// Copyright Christoffer G. Thomsen 2016
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE or copy at
+// http://www.boost.org/LICENSE_1_0.txt)
+
+package authkeys
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// genKey returns a freshly generated ed25519 Key with the given comment,
+// suitable for round-tripping through Marshal/Parse in tests.
+func genKey(t *testing.T, comment string) Key {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Key{Key: sshPub, Comment: comment}
+}
+
+func TestReadAllWriteAllRoundTrip(t *testing.T) {
+	k1 := genKey(t, "alice@example.com")
+	k1.Options = []string{"no-port-forwarding", "no-agent-forwarding"}
+	k2 := genKey(t, "bob@example.com")
+
+	var in bytes.Buffer
+	in.WriteString("# a comment line\n")
+	in.WriteString("\n")
+	in.Write(k1.Marshal())
+	in.Write(k2.Marshal())
+	want := in.String()
+
+	keys, err := ReadAll(&in, DefaultAllowedAlgos)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(keys) != 4 {
+		t.Fatalf("got %d entries, want 4 (comment, blank, 2 keys)", len(keys))
+	}
+
+	parsed := List(keys)
+	if len(parsed) != 2 {
+		t.Fatalf("got %d parsed keys, want 2", len(parsed))
+	}
+	if !parsed[0].Equal(k1) || parsed[0].Comment != k1.Comment {
+		t.Errorf("first key didn't round-trip: got comment %q, want %q", parsed[0].Comment, k1.Comment)
+	}
+	if len(parsed[0].Options) != 2 {
+		t.Errorf("got %d options on first key, want 2", len(parsed[0].Options))
+	}
+	if !parsed[1].Equal(k2) {
+		t.Errorf("second key didn't round-trip")
+	}
+
+	var out bytes.Buffer
+	if err := WriteAll(&out, keys); err != nil {
+		t.Fatalf("WriteAll: %v", err)
+	}
+	if out.String() != want {
+		t.Errorf("WriteAll(ReadAll(x)) != x\ngot:  %q\nwant: %q", out.String(), want)
+	}
+}
+
+func TestReadAllNoTrailingNewline(t *testing.T) {
+	k1 := genKey(t, "alice@example.com")
+	k2 := genKey(t, "bob@example.com")
+
+	var in bytes.Buffer
+	in.Write(k1.Marshal())
+	in.Write(bytes.TrimSuffix(k2.Marshal(), []byte("\n")))
+
+	keys, err := ReadAll(&in, DefaultAllowedAlgos)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	parsed := List(keys)
+	if len(parsed) != 2 {
+		t.Fatalf("got %d keys, want 2 (last line lacking a trailing newline must not be dropped)", len(parsed))
+	}
+	if !parsed[1].Equal(k2) {
+		t.Errorf("last key didn't round-trip")
+	}
+}
+
+func TestParseRejectsDisallowedAlgo(t *testing.T) {
+	k := genKey(t, "alice@example.com")
+	if _, err := Parse(k.Marshal(), []string{ssh.KeyAlgoRSA}); err == nil {
+		t.Error("Parse accepted an ed25519 key against an RSA-only allowlist")
+	}
+}
+
+func TestAddRejectsDuplicate(t *testing.T) {
+	k := genKey(t, "alice@example.com")
+	keys, err := Add(nil, k)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := Add(keys, k); err == nil {
+		t.Error("Add allowed adding an equal key twice")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	k1 := genKey(t, "alice@example.com")
+	k2 := genKey(t, "bob@example.com")
+	keys := []Key{k1, k2}
+
+	kept, removed := Remove(keys, func(k Key) bool { return k.Comment == "alice@example.com" })
+	if removed != 1 {
+		t.Fatalf("removed %d keys, want 1", removed)
+	}
+	if len(kept) != 1 || !kept[0].Equal(k2) {
+		t.Errorf("kept the wrong key set: %+v", kept)
+	}
+}
+
+func TestWriteAllEmpty(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteAll(&out, nil); err != nil {
+		t.Fatalf("WriteAll(nil): %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("WriteAll(nil) wrote %d bytes, want 0", out.Len())
+	}
+}
+
+func TestRotate(t *testing.T) {
+	oldKey := genKey(t, "alice@example.com")
+	newKey := genKey(t, "alice@example.com")
+	keys := []Key{oldKey}
+
+	rotated, err := Rotate(keys, oldKey, newKey)
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if len(rotated) != 1 || !rotated[0].Equal(newKey) {
+		t.Errorf("Rotate didn't replace the key: %+v", rotated)
+	}
+
+	if _, err := Rotate(keys, newKey, oldKey); err == nil {
+		t.Error("Rotate found a key that isn't present")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright Christoffer G. Thomsen 2016
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE or copy at
+// http://www.boost.org/LICENSE_1_0.txt)
+
+package main // import "cgt.name/pkg/addkey"
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ssh"
+
+	"cgt.name/pkg/addkey/authkeys"
+)
+
+// defaultRSABits and defaultECDSABits are used when -bits isn't given for
+// the corresponding -type.
+const (
+	defaultRSABits   = 4096
+	defaultECDSABits = 256
+)
+
+// generateKeyPair creates a new keypair of the given type ("ed25519",
+// "rsa", or "ecdsa") and returns the private key and its corresponding ssh
+// public key.
+func generateKeyPair(keyType string, bits int) (priv interface{}, pub ssh.PublicKey, err error) {
+	switch keyType {
+	case "ed25519":
+		pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		sshPub, err := ssh.NewPublicKey(pubKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privKey, sshPub, nil
+
+	case "rsa":
+		if bits == 0 {
+			bits = defaultRSABits
+		}
+		privKey, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		sshPub, err := ssh.NewPublicKey(&privKey.PublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privKey, sshPub, nil
+
+	case "ecdsa":
+		var curve elliptic.Curve
+		switch bits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, nil, fmt.Errorf("unsupported ecdsa key size %d (supported: 256, 384, 521)", bits)
+		}
+		privKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		sshPub, err := ssh.NewPublicKey(&privKey.PublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privKey, sshPub, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %q (supported: ed25519, rsa, ecdsa)", keyType)
+	}
+}
+
+// writeGeneratedKeyPair writes priv and pub as an OpenSSH private key (mode
+// 0600) and authorized_keys-format public key (mode 0644), at privPath and
+// privPath+".pub" respectively.
+func writeGeneratedKeyPair(priv interface{}, pub ssh.PublicKey, comment, privPath string) error {
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return fmt.Errorf("encoding private key: %v", err)
+	}
+	if err := ioutil.WriteFile(privPath, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+
+	pubKey := authkeys.Key{Key: pub, Comment: comment}
+	if err := ioutil.WriteFile(privPath+".pub", pubKey.Marshal(), 0644); err != nil {
+		return err
+	}
+
+	return nil
+}
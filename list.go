@@ -0,0 +1,72 @@
+// Copyright Christoffer G. Thomsen 2016
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE or copy at
+// http://www.boost.org/LICENSE_1_0.txt)
+
+package main // import "cgt.name/pkg/addkey"
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"cgt.name/pkg/addkey/authkeys"
+)
+
+// runList implements `addkey list`, printing each target's keys as
+// "<fingerprint> <algorithm> <comment>".
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	userFlag := fs.String("u", defaultUser, "user whose authorized_keys to list, unless overridden per-target")
+	remoteFlag := fs.String("remote", "", "LXD remote to use, as configured for the lxc/lxd CLI (default: local daemon socket)")
+	allFlag := fs.Bool("all", false, "operate on every running container reported by LXD, instead of the targets given on the command line")
+	algosFlag := fs.String("algos", "", "comma-separated allowlist of accepted key algorithms (default: all algorithms supported by x/crypto/ssh except ssh-dss)")
+	fs.Parse(args)
+
+	targetArgs := fs.Args()
+	if len(targetArgs) == 0 && !*allFlag {
+		fs.Usage()
+		return errors.New("no targets given")
+	}
+
+	allowed := authkeys.DefaultAllowedAlgos
+	if len(*algosFlag) != 0 {
+		allowed = strings.Split(*algosFlag, ",")
+	}
+
+	targets, err := resolveTargets(targetArgs, *userFlag, *remoteFlag, *allFlag)
+	if err != nil {
+		return err
+	}
+
+	cc := newClientCache(*remoteFlag)
+	var failed []string
+	for _, t := range targets {
+		c, err := cc.get(t.Remote)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: error connecting to LXD: %v", t, err))
+			continue
+		}
+
+		keys, err := t.Pull(c, allowed)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", t, err))
+			continue
+		}
+
+		if len(targets) > 1 {
+			fmt.Printf("%s:\n", t)
+		}
+		for _, k := range authkeys.List(keys) {
+			fmt.Printf("%s %s %s\n", k.Fingerprint(), k.Key.Type(), k.Comment)
+		}
+	}
+
+	if len(failed) != 0 {
+		fmt.Fprintln(os.Stderr, strings.Join(failed, "\n"))
+		return fmt.Errorf("%d/%d targets failed", len(failed), len(targets))
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+// Copyright Christoffer G. Thomsen 2016
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE or copy at
+// http://www.boost.org/LICENSE_1_0.txt)
+
+package main // import "cgt.name/pkg/addkey"
+
+import "sync"
+
+// targetLocker hands out one *sync.Mutex per distinct remote/container, so
+// that concurrent targets of one addkey process against the same container
+// serialize their authorized_keys rewrites instead of racing. The locks live
+// in process memory only: separate addkey processes are not serialized. This is the same role the
+// sshOpLocker pattern plays in Gitea/Gogs's authorized_keys writers.
+type targetLocker struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+var targetLocks = &targetLocker{locks: make(map[string]*sync.Mutex)}
+
+// lockFor returns the mutex for key, creating it on first use.
+func (tl *targetLocker) lockFor(key string) *sync.Mutex {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	m, ok := tl.locks[key]
+	if !ok {
+		m = &sync.Mutex{}
+		tl.locks[key] = m
+	}
+	return m
+}
@@ -0,0 +1,394 @@
+// Copyright Christoffer G. Thomsen 2016
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE or copy at
+// http://www.boost.org/LICENSE_1_0.txt)
+
+package main // import "cgt.name/pkg/addkey"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultSocket is the local LXD daemon's Unix socket, used when no -remote
+// flag is given.
+const defaultSocket = "/var/lib/lxd/unix.socket"
+
+// Client talks to an LXD daemon's REST API to read and write files inside
+// containers.
+type Client interface {
+	// PullFile returns the contents of path inside container. If path
+	// doesn't exist, it returns errNotFound.
+	PullFile(container, path string) ([]byte, error)
+	// PushFile writes data to path inside container, owned by uid:gid
+	// with the given file mode.
+	PushFile(container, path string, data []byte, uid, gid int, mode os.FileMode) error
+	// ListRunning returns the names of all running containers.
+	ListRunning() ([]string, error)
+	// Exec runs a non-interactive command inside container and blocks
+	// until it finishes, returning an error if it didn't exit 0.
+	Exec(container string, cmd []string) error
+	// ContainerIP returns a routable IPv4 address reported by container's
+	// runtime state.
+	ContainerIP(container string) (string, error)
+}
+
+// errNotFound is returned by PullFile when path doesn't exist inside the
+// container, e.g. a freshly-launched container with no authorized_keys yet.
+var errNotFound = errors.New("not found")
+
+// lxdError is the JSON body LXD returns for non-2xx responses.
+type lxdError struct {
+	Type      string `json:"type"`
+	Error     string `json:"error"`
+	ErrorCode int    `json:"error_code"`
+}
+
+// httpClient is a Client backed by the LXD REST API, either over a local
+// Unix socket or a remote HTTPS endpoint.
+type httpClient struct {
+	base string
+	hc   *http.Client
+}
+
+// newLocalClient returns a Client that talks to the LXD daemon over its
+// local Unix socket.
+func newLocalClient() (*httpClient, error) {
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", defaultSocket)
+			},
+		},
+	}
+	return &httpClient{base: "http://unix.socket", hc: hc}, nil
+}
+
+// newRemoteClient returns a Client that talks to the given LXD remote over
+// HTTPS, authenticating with the remote's client certificate.
+func newRemoteClient(remote remoteConfig) (*httpClient, error) {
+	cert, err := tls.LoadX509KeyPair(remote.CertFile, remote.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate for remote %q: %v", remote.Name, err)
+	}
+
+	hc := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				// LXD remotes use trust-on-first-use via
+				// certificate fingerprint rather than a CA, so
+				// there is no chain to verify here.
+				InsecureSkipVerify: true,
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+	return &httpClient{base: remote.Addr, hc: hc}, nil
+}
+
+func (c *httpClient) filesURL(container, path string) string {
+	v := url.Values{}
+	v.Set("path", path)
+	return fmt.Sprintf("%s/1.0/containers/%s/files?%s", c.base, url.PathEscape(container), v.Encode())
+}
+
+func (c *httpClient) PullFile(container, path string) ([]byte, error) {
+	resp, err := c.hc.Get(c.filesURL(container, path))
+	if err != nil {
+		return nil, fmt.Errorf("pulling %s:%s: %v", container, path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("pulling %s:%s: %v", container, path, err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pulling %s:%s: %v", container, path, parseLXDError(resp.StatusCode, body))
+	}
+
+	return body, nil
+}
+
+func (c *httpClient) PushFile(container, path string, data []byte, uid, gid int, mode os.FileMode) error {
+	req, err := http.NewRequest(http.MethodPost, c.filesURL(container, path), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("pushing %s:%s: %v", container, path, err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-LXD-uid", fmt.Sprintf("%d", uid))
+	req.Header.Set("X-LXD-gid", fmt.Sprintf("%d", gid))
+	req.Header.Set("X-LXD-mode", fmt.Sprintf("%04o", mode.Perm()))
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("pushing %s:%s: %v", container, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("pushing %s:%s: %v", container, path, parseLXDError(resp.StatusCode, body))
+	}
+
+	return nil
+}
+
+// containerState is the subset of LXD's container API response used to
+// determine which containers are running. At recursion=1, a container's
+// runtime status is the top-level "status" field, not a nested "state"
+// object (that only appears at recursion=2).
+type containerState struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+func (c *httpClient) ListRunning() ([]string, error) {
+	resp, err := c.hc.Get(c.base + "/1.0/containers?recursion=1")
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing containers: %v", parseLXDError(resp.StatusCode, body))
+	}
+
+	var envelope struct {
+		Metadata []containerState `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("listing containers: %v", err)
+	}
+
+	var running []string
+	for _, ct := range envelope.Metadata {
+		if ct.Status == "Running" {
+			running = append(running, ct.Name)
+		}
+	}
+	return running, nil
+}
+
+// Exec runs a non-interactive command inside container, using LXD's exec
+// API and its operation-wait endpoint to block until the command finishes.
+func (c *httpClient) Exec(container string, cmd []string) error {
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"command":            cmd,
+		"wait-for-websocket": false,
+		"interactive":        false,
+	})
+	if err != nil {
+		return err
+	}
+
+	execURL := fmt.Sprintf("%s/1.0/containers/%s/exec", c.base, url.PathEscape(container))
+	resp, err := c.hc.Post(execURL, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("exec %v on %s: %v", cmd, container, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("exec %v on %s: %v", cmd, container, err)
+	}
+	// Exec always starts a background operation, so LXD answers 202
+	// Accepted here; the actual result comes from polling /wait below.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("exec %v on %s: %v", cmd, container, parseLXDError(resp.StatusCode, body))
+	}
+
+	var op struct {
+		Metadata struct {
+			ID string `json:"id"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &op); err != nil {
+		return fmt.Errorf("exec %v on %s: %v", cmd, container, err)
+	}
+
+	waitResp, err := c.hc.Get(c.base + "/1.0/operations/" + op.Metadata.ID + "/wait")
+	if err != nil {
+		return fmt.Errorf("exec %v on %s: waiting for completion: %v", cmd, container, err)
+	}
+	defer waitResp.Body.Close()
+
+	waitBody, err := ioutil.ReadAll(waitResp.Body)
+	if err != nil {
+		return fmt.Errorf("exec %v on %s: %v", cmd, container, err)
+	}
+	if waitResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("exec %v on %s: %v", cmd, container, parseLXDError(waitResp.StatusCode, waitBody))
+	}
+
+	var result struct {
+		Metadata struct {
+			Status   string `json:"status"`
+			Metadata struct {
+				Return int `json:"return"`
+			} `json:"metadata"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(waitBody, &result); err != nil {
+		return fmt.Errorf("exec %v on %s: %v", cmd, container, err)
+	}
+	if result.Metadata.Metadata.Return != 0 {
+		return fmt.Errorf("exec %v on %s: exited with status %d", cmd, container, result.Metadata.Metadata.Return)
+	}
+
+	return nil
+}
+
+// ContainerIP returns a global-scope IPv4 address reported in container's
+// network state, skipping the loopback interface. When several interfaces
+// have one, which of them is returned is not defined.
+func (c *httpClient) ContainerIP(container string) (string, error) {
+	resp, err := c.hc.Get(fmt.Sprintf("%s/1.0/containers/%s/state", c.base, url.PathEscape(container)))
+	if err != nil {
+		return "", fmt.Errorf("getting state of %s: %v", container, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("getting state of %s: %v", container, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting state of %s: %v", container, parseLXDError(resp.StatusCode, body))
+	}
+
+	var state struct {
+		Metadata struct {
+			Network map[string]struct {
+				Addresses []struct {
+					Family  string `json:"family"`
+					Address string `json:"address"`
+					Scope   string `json:"scope"`
+				} `json:"addresses"`
+			} `json:"network"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &state); err != nil {
+		return "", fmt.Errorf("getting state of %s: %v", container, err)
+	}
+
+	for name, iface := range state.Metadata.Network {
+		if name == "lo" {
+			continue
+		}
+		for _, addr := range iface.Addresses {
+			if addr.Family == "inet" && addr.Scope == "global" {
+				return addr.Address, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no IPv4 address found for %s", container)
+}
+
+func parseLXDError(status int, body []byte) error {
+	var e lxdError
+	if err := json.Unmarshal(body, &e); err != nil || e.Error == "" {
+		return fmt.Errorf("unexpected status %d", status)
+	}
+	return fmt.Errorf("%s (code %d)", e.Error, e.ErrorCode)
+}
+
+// remoteConfig is a single entry from an LXD/lxc client config.yml, with its
+// client certificate resolved to files on disk.
+type remoteConfig struct {
+	Name     string
+	Addr     string
+	CertFile string
+	KeyFile  string
+}
+
+// lookupRemote parses the user's LXD client configuration and returns the
+// addr and client cert/key for the named remote. It checks
+// ~/snap/lxd/common/config/config.yml (the snap-confined location) before
+// falling back to ~/.config/lxc/config.yml.
+func lookupRemote(name string) (remoteConfig, error) {
+	home := os.Getenv("HOME")
+	candidates := []string{
+		filepath.Join(home, "snap", "lxd", "common", "config", "config.yml"),
+		filepath.Join(home, ".config", "lxc", "config.yml"),
+	}
+
+	for _, path := range candidates {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		addr, ok := parseRemoteAddr(f, name)
+		f.Close()
+		if !ok {
+			continue
+		}
+
+		dir := filepath.Dir(path)
+		return remoteConfig{
+			Name:     name,
+			Addr:     addr,
+			CertFile: filepath.Join(dir, "client.crt"),
+			KeyFile:  filepath.Join(dir, "client.key"),
+		}, nil
+	}
+
+	return remoteConfig{}, fmt.Errorf("remote %q not found in lxc/lxd client config", name)
+}
+
+// parseRemoteAddr does a minimal scan of an lxc/lxd config.yml for
+// remotes.<name>.addr, avoiding a dependency on a full YAML parser for this
+// one flat lookup.
+func parseRemoteAddr(r *os.File, name string) (string, bool) {
+	s := bufio.NewScanner(r)
+	inRemotes := false
+	inTarget := false
+	for s.Scan() {
+		line := s.Text()
+		trimmed := strings.TrimRight(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		switch {
+		case indent == 0:
+			inRemotes = strings.TrimSpace(trimmed) == "remotes:"
+			inTarget = false
+		case inRemotes && indent == 2:
+			inTarget = strings.TrimSpace(trimmed) == name+":"
+		case inRemotes && inTarget && indent >= 4:
+			kv := strings.TrimSpace(trimmed)
+			if i := strings.Index(kv, ":"); i >= 0 && strings.TrimSpace(kv[:i]) == "addr" {
+				return strings.Trim(strings.TrimSpace(kv[i+1:]), `"'`), true
+			}
+		}
+	}
+	return "", false
+}
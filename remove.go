@@ -0,0 +1,102 @@
+// Copyright Christoffer G. Thomsen 2016
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE or copy at
+// http://www.boost.org/LICENSE_1_0.txt)
+
+package main // import "cgt.name/pkg/addkey"
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"cgt.name/pkg/addkey/authkeys"
+)
+
+// removeFromTarget pulls t's authorized_keys, removes every key matching
+// pred, and pushes the result back if anything was removed. It holds t's
+// lock for the duration, so targets of this addkey process that share a
+// remote/container serialize; separate addkey processes are not serialized.
+func removeFromTarget(cc *clientCache, t Target, pred func(authkeys.Key) bool, allowed []string) (int, error) {
+	lock := targetLocks.lockFor(t.lockKey())
+	lock.Lock()
+	defer lock.Unlock()
+
+	c, err := cc.get(t.Remote)
+	if err != nil {
+		return 0, fmt.Errorf("error connecting to LXD: %v", err)
+	}
+
+	original, err := t.PullRaw(c)
+	if err != nil {
+		return 0, err
+	}
+
+	keys, err := authkeys.ReadAll(bytes.NewReader(original), allowed)
+	if err != nil {
+		return 0, err
+	}
+
+	kept, removed := authkeys.Remove(keys, pred)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if err := t.Push(c, kept, original); err != nil {
+		return 0, fmt.Errorf("error pushing new authorized_keys: %v", err)
+	}
+
+	return removed, nil
+}
+
+// runRemove implements `addkey remove`.
+func runRemove(args []string) error {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	fingerprintFlag := fs.String("f", "", "remove the key with this SHA256 fingerprint")
+	commentFlag := fs.String("c", "", "remove keys with this comment")
+	userFlag := fs.String("u", defaultUser, "user whose authorized_keys to edit, unless overridden per-target")
+	remoteFlag := fs.String("remote", "", "LXD remote to use, as configured for the lxc/lxd CLI (default: local daemon socket)")
+	allFlag := fs.Bool("all", false, "operate on every running container reported by LXD, instead of the targets given on the command line")
+	algosFlag := fs.String("algos", "", "comma-separated allowlist of accepted key algorithms (default: all algorithms supported by x/crypto/ssh except ssh-dss)")
+	fs.Parse(args)
+
+	if len(*fingerprintFlag) == 0 && len(*commentFlag) == 0 {
+		return errors.New("one of -f FINGERPRINT or -c COMMENT is required")
+	}
+	if len(*fingerprintFlag) != 0 && len(*commentFlag) != 0 {
+		return errors.New("-f FINGERPRINT and -c COMMENT are mutually exclusive")
+	}
+
+	targetArgs := fs.Args()
+	if len(targetArgs) == 0 && !*allFlag {
+		fs.Usage()
+		return errors.New("no targets given")
+	}
+
+	allowed := authkeys.DefaultAllowedAlgos
+	if len(*algosFlag) != 0 {
+		allowed = strings.Split(*algosFlag, ",")
+	}
+
+	var pred func(authkeys.Key) bool
+	if len(*fingerprintFlag) != 0 {
+		pred = func(k authkeys.Key) bool { return k.Fingerprint() == *fingerprintFlag }
+	} else {
+		pred = func(k authkeys.Key) bool { return k.Comment == *commentFlag }
+	}
+
+	targets, err := resolveTargets(targetArgs, *userFlag, *remoteFlag, *allFlag)
+	if err != nil {
+		return err
+	}
+
+	cc := newClientCache(*remoteFlag)
+	results := processTargets(targets, func(t Target) error {
+		_, err := removeFromTarget(cc, t, pred, allowed)
+		return err
+	})
+
+	return summarizeResults(results)
+}
@@ -0,0 +1,117 @@
+// Copyright Christoffer G. Thomsen 2016
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE or copy at
+// http://www.boost.org/LICENSE_1_0.txt)
+
+package main // import "cgt.name/pkg/addkey"
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"cgt.name/pkg/addkey/authkeys"
+)
+
+// rotateTarget pulls t's authorized_keys, replaces oldKey with newKey, and
+// pushes the result back in a single atomic write. It holds t's lock for
+// the duration, so targets of this addkey process that share a
+// remote/container serialize; separate addkey processes are not serialized.
+func rotateTarget(cc *clientCache, t Target, oldKey, newKey authkeys.Key, allowed []string) error {
+	lock := targetLocks.lockFor(t.lockKey())
+	lock.Lock()
+	defer lock.Unlock()
+
+	c, err := cc.get(t.Remote)
+	if err != nil {
+		return fmt.Errorf("error connecting to LXD: %v", err)
+	}
+
+	original, err := t.PullRaw(c)
+	if err != nil {
+		return err
+	}
+
+	keys, err := authkeys.ReadAll(bytes.NewReader(original), allowed)
+	if err != nil {
+		return err
+	}
+
+	keys, err = authkeys.Rotate(keys, oldKey, newKey)
+	if err != nil {
+		return err
+	}
+
+	if err := t.Push(c, keys, original); err != nil {
+		return fmt.Errorf("error pushing new authorized_keys: %v", err)
+	}
+
+	return nil
+}
+
+// runRotate implements `addkey rotate`.
+func runRotate(args []string) error {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	oldKeyFlag := fs.String("i", "", "public key file to replace (required)")
+	newKeyFlag := fs.String("j", "", "public key file to replace it with (required)")
+	userFlag := fs.String("u", defaultUser, "user whose authorized_keys to edit, unless overridden per-target")
+	remoteFlag := fs.String("remote", "", "LXD remote to use, as configured for the lxc/lxd CLI (default: local daemon socket)")
+	allFlag := fs.Bool("all", false, "operate on every running container reported by LXD, instead of the targets given on the command line")
+	algosFlag := fs.String("algos", "", "comma-separated allowlist of accepted key algorithms (default: all algorithms supported by x/crypto/ssh except ssh-dss)")
+	fs.Parse(args)
+
+	if len(*oldKeyFlag) == 0 || len(*newKeyFlag) == 0 {
+		return errors.New("both -i OLDKEY and -j NEWKEY are required")
+	}
+
+	targetArgs := fs.Args()
+	if len(targetArgs) == 0 && !*allFlag {
+		fs.Usage()
+		return errors.New("no targets given")
+	}
+
+	allowed := authkeys.DefaultAllowedAlgos
+	if len(*algosFlag) != 0 {
+		allowed = strings.Split(*algosFlag, ",")
+	}
+
+	oldKey, err := readKeyFile(*oldKeyFlag, allowed)
+	if err != nil {
+		return fmt.Errorf("error reading old key: %v", err)
+	}
+	newKey, err := readKeyFile(*newKeyFlag, allowed)
+	if err != nil {
+		return fmt.Errorf("error reading new key: %v", err)
+	}
+
+	targets, err := resolveTargets(targetArgs, *userFlag, *remoteFlag, *allFlag)
+	if err != nil {
+		return err
+	}
+
+	cc := newClientCache(*remoteFlag)
+	results := processTargets(targets, func(t Target) error {
+		return rotateTarget(cc, t, oldKey, newKey, allowed)
+	})
+
+	return summarizeResults(results)
+}
+
+// readKeyFile reads and parses a single public key file.
+func readKeyFile(path string, allowed []string) (authkeys.Key, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return authkeys.Key{}, err
+	}
+	key, err := authkeys.Parse(buf, allowed)
+	if err != nil {
+		return authkeys.Key{}, err
+	}
+	if key.Key == nil {
+		return authkeys.Key{}, fmt.Errorf("%s does not contain a key", path)
+	}
+	return key, nil
+}
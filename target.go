@@ -0,0 +1,189 @@
+// Copyright Christoffer G. Thomsen 2016
+// Distributed under the Boost Software License, Version 1.0.
+// (See accompanying file LICENSE or copy at
+// http://www.boost.org/LICENSE_1_0.txt)
+
+package main // import "cgt.name/pkg/addkey"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cgt.name/pkg/addkey/authkeys"
+)
+
+// maxConcurrentTargets bounds how many containers addkey talks to at once,
+// so a large `--all` run doesn't open hundreds of connections simultaneously.
+const maxConcurrentTargets = 8
+
+// defaultUser is the user whose authorized_keys is edited when a target
+// doesn't specify one.
+const defaultUser = "root"
+
+// Target identifies a single container and user to edit authorized_keys
+// for, optionally on a non-default LXD remote.
+//
+// Targets are written on the command line as `[remote:]container[/user]`.
+type Target struct {
+	Remote    string
+	Container string
+	User      string
+}
+
+func (t Target) String() string {
+	s := t.Container
+	if len(t.Remote) != 0 {
+		s = t.Remote + ":" + s
+	}
+	if t.User != defaultUser {
+		s += "/" + t.User
+	}
+	return s
+}
+
+// homeDir returns the home directory addkey assumes for user.
+func homeDir(user string) string {
+	if user == "root" {
+		return "/root"
+	}
+	return "/home/" + user
+}
+
+// authKeysPath returns the path to t's user's authorized_keys file inside
+// its container.
+func (t Target) authKeysPath() string {
+	return homeDir(t.User) + "/.ssh/authorized_keys"
+}
+
+// parseTarget parses a `[remote:]container[/user]` command-line argument.
+func parseTarget(s, defaultUser string) (Target, error) {
+	t := Target{User: defaultUser}
+
+	rest := s
+	if i := strings.Index(s, ":"); i >= 0 {
+		t.Remote = s[:i]
+		rest = s[i+1:]
+	}
+
+	t.Container = rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		t.Container = rest[:i]
+		t.User = rest[i+1:]
+	}
+
+	if len(t.Container) == 0 {
+		return Target{}, fmt.Errorf("invalid target %q: missing container name", s)
+	}
+
+	return t, nil
+}
+
+// lockKey identifies t for targetLocker, so that two targets naming the
+// same remote/container (even under different users) serialize.
+func (t Target) lockKey() string {
+	return t.Remote + ":" + t.Container
+}
+
+// PullRaw fetches t's authorized_keys file as raw bytes. A missing file,
+// e.g. in a freshly-launched container, is treated as an empty one rather
+// than an error.
+func (t Target) PullRaw(c Client) ([]byte, error) {
+	buf, err := c.PullFile(t.Container, t.authKeysPath())
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	return buf, err
+}
+
+// Pull fetches and parses t's authorized_keys file.
+func (t Target) Pull(c Client, allowed []string) ([]authkeys.Key, error) {
+	buf, err := t.PullRaw(c)
+	if err != nil {
+		return nil, err
+	}
+	return authkeys.ReadAll(bytes.NewReader(buf), allowed)
+}
+
+// Push atomically rewrites t's authorized_keys file with keys, restoring
+// original (t's previous raw contents, as returned by PullRaw) if the
+// rewrite fails partway through.
+func (t Target) Push(c Client, keys []authkeys.Key, original []byte) error {
+	return writeAuthorizedKeys(c, t.Container, t.authKeysPath(), t.User, keys, original)
+}
+
+// resolveTargets builds the list of targets to operate on: either the
+// explicit `[remote:]container[/user]` arguments, or, with all, every
+// running container reported by the LXD remote selected by remote.
+func resolveTargets(args []string, user, remote string, all bool) ([]Target, error) {
+	if all {
+		c, err := newClient(remote)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to LXD: %v", err)
+		}
+		names, err := c.ListRunning()
+		if err != nil {
+			return nil, err
+		}
+		targets := make([]Target, len(names))
+		for i, name := range names {
+			targets[i] = Target{Remote: remote, Container: name, User: user}
+		}
+		return targets, nil
+	}
+
+	targets := make([]Target, len(args))
+	for i, arg := range args {
+		t, err := parseTarget(arg, user)
+		if err != nil {
+			return nil, err
+		}
+		targets[i] = t
+	}
+	return targets, nil
+}
+
+// targetResult is the outcome of processing a single target.
+type targetResult struct {
+	target Target
+	err    error
+}
+
+// processTargets runs fn for each target concurrently, bounded to
+// maxConcurrentTargets at a time, and returns one result per target in the
+// same order. A failure on one target does not stop the others.
+func processTargets(targets []Target, fn func(Target) error) []targetResult {
+	results := make([]targetResult, len(targets))
+	sem := make(chan struct{}, maxConcurrentTargets)
+	var wg sync.WaitGroup
+
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t Target) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = targetResult{target: t, err: fn(t)}
+		}(i, t)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// summarizeResults returns a combined error listing every failed target, or
+// nil if all targets succeeded.
+func summarizeResults(results []targetResult) error {
+	var failed []string
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", r.target, r.err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d/%d targets failed:\n%s", len(failed), len(results), strings.Join(failed, "\n"))
+}